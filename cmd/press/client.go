@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// newHTTPClient builds a single *http.Client shared by all workers, with a
+// Transport tuned to keep up to two idle connections per worker alive instead of
+// dialing a fresh connection (and socket) on every post.
+func newHTTPClient(concurrency int) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        concurrency * 2,
+			MaxIdleConnsPerHost: concurrency * 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// bufferPool recycles the *bytes.Buffer used to hold the encoded request
+// body, avoiding a fresh allocation for every batch of samples.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// samplePool recycles the []PutSample slices built per metric so that
+// sustained load doesn't churn the GC with one slice per tick per worker.
+var samplePool = sync.Pool{
+	New: func() interface{} { return make([]PutSample, 0, 4000) },
+}
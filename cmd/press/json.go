@@ -0,0 +1,18 @@
+package main
+
+import (
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsonAPI is configured to be drop-in compatible with encoding/json while
+// using jsoniter's faster reflection-free codecs for the []PutSample shape
+// posted on every tick.
+var jsonAPI = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// encodeSamples streams samples into w using jsonAPI instead of building the
+// whole encoded buffer with json.Marshal up front.
+func encodeSamples(w io.Writer, samples []PutSample) error {
+	return jsonAPI.NewEncoder(w).Encode(samples)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func benchSamples() []PutSample {
+	samples := make([]PutSample, 0, samplesPerMetric)
+	for _, rg := range []string{"bj", "sq", "sh", "gz"} {
+		for i := 0; i < 1000; i++ {
+			samples = append(samples, PutSample{
+				Metric:    "test_metric_0",
+				TimeStamp: 1690000000000,
+				Value:     0.5,
+				Tags: map[string]string{
+					"region": rg,
+					"ns":     fmt.Sprintf("ns-%d", i),
+				},
+			})
+		}
+	}
+	return samples
+}
+
+func BenchmarkEncodeStdlib(b *testing.B) {
+	samples := benchSamples()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := json.NewEncoder(&buf).Encode(samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeJsoniter(b *testing.B) {
+	samples := benchSamples()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := encodeSamples(&buf, samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
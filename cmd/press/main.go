@@ -2,17 +2,35 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
+const samplesPerMetric = 4000 // len(dc) * 1000, see buildSyntheticBatch.
+
 var (
-	url string
+	putURL      string
+	protoMode   string
+	concurrency int
+	metricsAddr string
+
+	targetPointRate float64
+	profileFlag     string
+	duration        time.Duration
+	warmup          time.Duration
+
+	payloadFile string
 )
 
 type PutSample struct {
@@ -23,58 +41,203 @@ type PutSample struct {
 }
 
 func init() {
-	flag.StringVar(&url, "url", "http://127.0.0.1:9090/api/v1/put", "Put url")
+	flag.StringVar(&putURL, "url", "http://127.0.0.1:9090/api/v1/put", "Put url")
+	flag.StringVar(&protoMode, "proto", "put", "Ingestion protocol to use: put or remote_write")
+	flag.IntVar(&concurrency, "concurrency", 4, "Number of parallel workers posting samples")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":9091", "Address to serve the generator's own /metrics on, empty to disable")
+	flag.Float64Var(&targetPointRate, "rate", 40000, "Target points/sec to emit")
+	flag.StringVar(&profileFlag, "profile", string(profileConstant), "Load profile: constant, ramp, sine or burst")
+	flag.DurationVar(&duration, "duration", 0, "How long to run the selected profile for, 0 to run indefinitely")
+	flag.DurationVar(&warmup, "warmup", 0, "Duration to linearly ramp up from 0 to -rate before the profile starts")
+	flag.StringVar(&payloadFile, "payload-file", "", "File of metric,tags,value rows to replay instead of the synthetic pattern: .csv for CSV, anything else for a curl-style k=v&k=v request template; supports $RAND/$NOW_MS/$SEQ placeholders")
 }
 
 func main() {
 	flag.Parse()
-	metrics := make([]string, 0, 100)
-	dc := []string{"bj", "sq", "sh", "gz"}
-	contentType := "application/json;charset=utf-8"
+	if protoMode != "put" && protoMode != "remote_write" {
+		log.Fatalf("unknown -proto %q, must be put or remote_write", protoMode)
+	}
+	if concurrency < 1 {
+		log.Fatalf("-concurrency must be >= 1, got %d", concurrency)
+	}
+	profile := loadProfile(profileFlag)
+	if !validProfile(profile) {
+		log.Fatalf("unknown -profile %q, must be constant, ramp, sine or burst", profileFlag)
+	}
+	writeURL := putURL
+	if protoMode == "remote_write" {
+		writeURL = remoteWriteURL(putURL)
+	}
+	rand.Seed(time.Now().Unix())
 
+	var payloadBatches [][]payloadRow
+	if payloadFile != "" {
+		rows, err := loadPayloadFile(payloadFile)
+		if err != nil {
+			log.Fatalf("-payload-file: %v", err)
+		}
+		payloadBatches = chunkPayload(rows, samplesPerMetric)
+	}
+
+	metricNames := make([]string, 0, 100)
 	for i := 0; i < 100; i++ {
-		metrics = append(metrics, fmt.Sprintf("test_metric_%d", i))
+		metricNames = append(metricNames, fmt.Sprintf("test_metric_%d", i))
+	}
+
+	reg := prometheus.NewRegistry()
+	metrics := newPressMetrics(reg)
+	serveMetrics(metricsAddr, reg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if duration > 0 {
+		time.AfterFunc(warmup+duration, cancel)
 	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		cancel()
+	}()
 
+	limiter := rate.NewLimiter(rate.Limit(targetPointRate), samplesPerMetric)
+	go runScheduler(ctx, limiter, profile, targetPointRate, warmup, duration)
+
+	client := newHTTPClient(concurrency)
+	batchCh := make(chan func() []PutSample, concurrency)
+	stats := &runStats{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go worker(ctx, client, writeURL, batchCh, limiter, metrics, stats, &wg)
+	}
+
+	start := time.Now()
 	// 100 * 4 * 1000 = 400000 线
 	// 每小时数据点：360 * 400000 = 144000000, 每小时1.44亿个数据点
 	// 相当于4000个机器的上报量
+dispatch:
 	for {
-		for _, metric := range metrics {
-			samples := make([]PutSample, 0, 1000)
-			rand.Seed(time.Now().Unix())
-			for _, rg := range dc {
-				for i := 0; i < 1000; i++ {
-					s := PutSample{
-						Metric:    metric,
-						TimeStamp: time.Now().UnixNano() / 1e6,
-						Value:     rand.Float64(),
-					}
-
-					tags := make(map[string]string)
-					tags["region"] = rg
-					tags["ns"] = fmt.Sprintf("ns-%d", i)
-
-					s.Tags = tags
-
-					samples = append(samples, s)
+		if payloadBatches != nil {
+			for _, batch := range payloadBatches {
+				batch := batch
+				select {
+				case batchCh <- func() []PutSample { return buildPayloadBatch(batch) }:
+				case <-ctx.Done():
+					break dispatch
 				}
 			}
-
-			b, err := json.Marshal(samples)
-			if err != nil {
-				log.Println("json format error:", err)
-				return
+			continue
+		}
+		for _, metric := range metricNames {
+			metric := metric
+			select {
+			case batchCh <- func() []PutSample { return buildSyntheticBatch(metric) }:
+			case <-ctx.Done():
+				break dispatch
 			}
+		}
+	}
+	close(batchCh)
+	wg.Wait()
+	stats.report(time.Since(start))
+}
 
-			body := bytes.NewBuffer(b)
-			_, err = http.Post(url, contentType, body)
+// buildSyntheticBatch generates the hard-coded dc x 1000 synthetic pattern
+// for a single metric name, reusing a pooled slice.
+func buildSyntheticBatch(metric string) []PutSample {
+	dc := []string{"bj", "sq", "sh", "gz"}
+	samples := samplePool.Get().([]PutSample)[:0]
+	for _, rg := range dc {
+		for i := 0; i < 1000; i++ {
+			samples = append(samples, PutSample{
+				Metric:    metric,
+				TimeStamp: time.Now().UnixNano() / 1e6,
+				Value:     rand.Float64(),
+				Tags: map[string]string{
+					"region": rg,
+					"ns":     fmt.Sprintf("ns-%d", i),
+				},
+			})
+		}
+	}
+	return samples
+}
+
+// buildPayloadBatch renders a batch of payload rows into samples,
+// substituting placeholders fresh for every replay.
+func buildPayloadBatch(rows []payloadRow) []PutSample {
+	samples := samplePool.Get().([]PutSample)[:0]
+	for _, row := range rows {
+		samples = append(samples, row.toSample())
+	}
+	return samples
+}
+
+// worker drains batch builders off batchCh and posts the generated samples
+// using the shared client, reusing pooled buffers/slices. Emission is paced
+// by lim, whose limit is continuously adjusted by the active load profile.
+func worker(ctx context.Context, client *http.Client, writeURL string, batchCh <-chan func() []PutSample, lim *rate.Limiter, metrics *pressMetrics, stats *runStats, wg *sync.WaitGroup) {
+	defer wg.Done()
+	contentType := "application/json;charset=utf-8"
+
+	for buildBatch := range batchCh {
+		samples := buildBatch()
+		if err := lim.WaitN(ctx, len(samples)); err != nil {
+			samplePool.Put(samples)
+			return
+		}
+
+		if protoMode == "remote_write" {
+			metrics.inFlight.Inc()
+			start := time.Now()
+			n, err := postRemoteWrite(client, writeURL, samples)
+			elapsed := time.Since(start)
+			metrics.requestDuration.Observe(elapsed.Seconds())
+			metrics.inFlight.Dec()
+			stats.record(elapsed, len(samples), err)
 			if err != nil {
-				log.Println("Post failed:", err)
-				return
+				log.Println("remote_write post failed:", err)
+				metrics.observeFailure(0)
+			} else {
+				metrics.samplesSent.Add(float64(len(samples)))
+				metrics.bytesSent.Add(float64(n))
 			}
+			samplePool.Put(samples)
+			continue
+		}
+
+		buf := bufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		marshalStart := time.Now()
+		if err := encodeSamples(buf, samples); err != nil {
+			log.Println("json format error:", err)
+			bufferPool.Put(buf)
+			samplePool.Put(samples)
+			continue
 		}
+		metrics.marshalDuration.Observe(time.Since(marshalStart).Seconds())
 
-		time.Sleep(time.Second * 10)
+		metrics.inFlight.Inc()
+		start := time.Now()
+		resp, err := client.Post(writeURL, contentType, buf)
+		elapsed := time.Since(start)
+		metrics.requestDuration.Observe(elapsed.Seconds())
+		metrics.inFlight.Dec()
+		stats.record(elapsed, len(samples), err)
+		if err != nil {
+			log.Println("Post failed:", err)
+			metrics.observeFailure(0)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				metrics.observeFailure(resp.StatusCode)
+			} else {
+				metrics.samplesSent.Add(float64(len(samples)))
+				metrics.bytesSent.Add(float64(buf.Len()))
+			}
+		}
+		bufferPool.Put(buf)
+		samplePool.Put(samples)
 	}
 }
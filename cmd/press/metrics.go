@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// pressMetrics holds the generator's own self-observability instrumentation,
+// scraped via -metrics-addr so operators can correlate client-side
+// throughput/latency with the server's ingestion metrics during a run.
+type pressMetrics struct {
+	samplesSent     prometheus.Counter
+	bytesSent       prometheus.Counter
+	requestFailures *prometheus.CounterVec
+	requestDuration prometheus.Histogram
+	marshalDuration prometheus.Histogram
+	inFlight        prometheus.Gauge
+}
+
+func newPressMetrics(r prometheus.Registerer) *pressMetrics {
+	m := &pressMetrics{
+		samplesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "press_samples_sent_total",
+			Help: "Total number of samples successfully posted.",
+		}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "press_bytes_sent_total",
+			Help: "Total number of request body bytes posted.",
+		}),
+		requestFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "press_request_failures_total",
+			Help: "Total number of failed HTTP requests, by status class.",
+		}, []string{"status_class"}),
+		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "press_request_duration_seconds",
+			Help:    "Duration of sample post requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		marshalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "press_marshal_duration_seconds",
+			Help:    "Duration of encoding a batch of samples before it is posted.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "press_in_flight_requests",
+			Help: "Number of sample post requests currently in flight.",
+		}),
+	}
+
+	r.MustRegister(
+		m.samplesSent,
+		m.bytesSent,
+		m.requestFailures,
+		m.requestDuration,
+		m.marshalDuration,
+		m.inFlight,
+	)
+	return m
+}
+
+// observeFailure buckets a non-2xx or transport-level failure under its
+// status class, e.g. "5xx" or "err" when no status code is available.
+func (m *pressMetrics) observeFailure(statusCode int) {
+	class := "err"
+	if statusCode > 0 {
+		class = strconv.Itoa(statusCode/100) + "xx"
+	}
+	m.requestFailures.WithLabelValues(class).Inc()
+}
+
+// serveMetrics starts the /metrics endpoint in the background if addr is
+// non-empty.
+func serveMetrics(addr string, gatherer prometheus.Gatherer) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("metrics server failed:", err)
+		}
+	}()
+}
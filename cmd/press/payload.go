@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// payloadRow is one parsed line of a -payload-file: a metric name, a set of
+// tags and a value, any of which may still contain $RAND/$NOW_MS/$SEQ
+// placeholders to be substituted at replay time.
+type payloadRow struct {
+	Metric string
+	Tags   map[string]string
+	Value  string
+}
+
+// loadPayloadFile parses a -payload-file, picking the format from its
+// extension: ".csv" loads loadPayloadCSV's "metric,tags,value" rows,
+// anything else is treated as loadPayloadTemplate's curl-style request
+// template, one per line.
+func loadPayloadFile(path string) ([]payloadRow, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return loadPayloadCSV(path)
+	}
+	return loadPayloadTemplate(path)
+}
+
+// loadPayloadCSV parses a CSV file of "metric,tags,value" rows, where tags
+// is a "k=v;k=v" list (semicolon-separated, since the tags column itself
+// sits between two CSV commas, and a comma-separated list inside it would
+// need hand-quoting to survive FieldsPerRecord), e.g.:
+//
+//	http_requests_total,region=bj;code=200,$RAND
+//
+// Lines starting with # are treated as comments.
+func loadPayloadCSV(path string) ([]payloadRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open payload file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	r.Comment = '#'
+
+	var rows []payloadRow
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse payload file %s: %w", path, err)
+		}
+		rows = append(rows, payloadRow{
+			Metric: strings.TrimSpace(rec[0]),
+			Tags:   parseTags(rec[1]),
+			Value:  strings.TrimSpace(rec[2]),
+		})
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("payload file %s contains no rows", path)
+	}
+	return rows, nil
+}
+
+// loadPayloadTemplate parses a file of curl-style request templates, one per
+// line: the same "key=value&key=value" query-string body curl's -d takes,
+// so a request captured straight off a production exporter's curl
+// invocation can be replayed without first reshaping it into CSV. The
+// metric/tags/value keys map onto payloadRow the same way the CSV columns
+// do, e.g.:
+//
+//	metric=http_requests_total&tags=region=bj;code=200&value=$RAND
+//
+// Lines starting with # are treated as comments.
+func loadPayloadTemplate(path string) ([]payloadRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open payload file: %w", err)
+	}
+	defer f.Close()
+
+	var rows []payloadRow
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// url.ParseQuery rejects a bare ';', which the tags value uses as
+		// its separator, so escape it first; ParseQuery decodes it back.
+		values, err := url.ParseQuery(strings.ReplaceAll(line, ";", "%3B"))
+		if err != nil {
+			return nil, fmt.Errorf("parse payload template %s: %w", path, err)
+		}
+		rows = append(rows, payloadRow{
+			Metric: values.Get("metric"),
+			Tags:   parseTags(values.Get("tags")),
+			Value:  values.Get("value"),
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read payload file %s: %w", path, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("payload file %s contains no rows", path)
+	}
+	return rows, nil
+}
+
+// parseTags turns "k=v;k2=v2" into a map, ignoring malformed entries.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// chunkPayload splits rows into batches of at most size rows each, so the
+// rate limiter and per-batch request shape line up with the synthetic mode.
+func chunkPayload(rows []payloadRow, size int) [][]payloadRow {
+	var batches [][]payloadRow
+	for size > 0 && len(rows) > 0 {
+		end := size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batches = append(batches, rows[:end])
+		rows = rows[end:]
+	}
+	return batches
+}
+
+var seqCounter int64
+
+// substitute replaces $RAND, $NOW_MS and $SEQ in s with a value computed
+// fresh for this particular sample.
+func substitute(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "$NOW_MS", strconv.FormatInt(time.Now().UnixNano()/1e6, 10))
+	s = strings.ReplaceAll(s, "$RAND", strconv.FormatFloat(rand.Float64(), 'f', 6, 64))
+	s = strings.ReplaceAll(s, "$SEQ", strconv.FormatInt(atomic.AddInt64(&seqCounter, 1), 10))
+	return s
+}
+
+// toSample renders a payloadRow into a concrete PutSample, substituting any
+// placeholders in the metric name, tag values and value.
+func (r payloadRow) toSample() PutSample {
+	tags := make(map[string]string, len(r.Tags))
+	for k, v := range r.Tags {
+		tags[k] = substitute(v)
+	}
+	value, _ := strconv.ParseFloat(substitute(r.Value), 64)
+	return PutSample{
+		Metric:    substitute(r.Metric),
+		Tags:      tags,
+		TimeStamp: time.Now().UnixNano() / 1e6,
+		Value:     value,
+	}
+}
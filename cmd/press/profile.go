@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// loadProfile selects the shape of the target rate over the life of a run.
+type loadProfile string
+
+const (
+	profileConstant loadProfile = "constant"
+	profileRamp     loadProfile = "ramp"
+	profileSine     loadProfile = "sine"
+	profileBurst    loadProfile = "burst"
+)
+
+func validProfile(p loadProfile) bool {
+	switch p {
+	case profileConstant, profileRamp, profileSine, profileBurst:
+		return true
+	}
+	return false
+}
+
+// targetRate returns the instantaneous target points/sec for profile p given
+// a peak of peakRate points/sec, elapsed time since the profile itself
+// started (i.e. after warmup), over a run lasting duration (0 = indefinite).
+func targetRate(p loadProfile, peakRate float64, elapsed, duration time.Duration) float64 {
+	switch p {
+	case profileRamp:
+		if duration <= 0 {
+			return peakRate
+		}
+		frac := float64(elapsed) / float64(duration)
+		if frac > 1 {
+			frac = 1
+		}
+		return peakRate * frac
+	case profileSine:
+		period := duration
+		if period <= 0 {
+			period = time.Hour
+		}
+		phase := 2 * math.Pi * float64(elapsed) / float64(period)
+		// Oscillates between 0 and peakRate, centred on peakRate/2, so a
+		// diurnal-style wave never asks for a negative rate.
+		return peakRate * (1 + math.Sin(phase)) / 2
+	case profileBurst:
+		const (
+			burstPeriod = 10 * time.Second
+			burstWidth  = time.Second
+		)
+		if elapsed%burstPeriod < burstWidth {
+			return peakRate * 5
+		}
+		return peakRate * 0.2
+	default: // profileConstant
+		return peakRate
+	}
+}
+
+// runScheduler keeps lim's limit in sync with the selected profile, ramping
+// linearly from zero over warmup before handing off to the profile function.
+// It returns once ctx is done.
+func runScheduler(ctx context.Context, lim *rate.Limiter, profile loadProfile, peakRate float64, warmup, duration time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		elapsed := time.Since(start)
+		var r float64
+		if elapsed < warmup {
+			if warmup > 0 {
+				r = peakRate * float64(elapsed) / float64(warmup)
+			}
+		} else {
+			r = targetRate(profile, peakRate, elapsed-warmup, duration)
+		}
+		if r <= 0 {
+			// A zero limit blocks WaitN forever; use a tiny floor instead
+			// so a ramp/sine trough still ticks rather than stalling.
+			r = 0.001
+		}
+		lim.SetLimit(rate.Limit(r))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteWriteURL is derived from -url by swapping the /api/v1/put suffix for
+// /api/v1/write, the endpoint exposed by the module's remote_write receiver.
+func remoteWriteURL(putURL string) string {
+	const putSuffix = "/api/v1/put"
+	if strings.HasSuffix(putURL, putSuffix) {
+		return strings.TrimSuffix(putURL, putSuffix) + "/api/v1/write"
+	}
+	return putURL
+}
+
+// toWriteRequest converts the samples generated for the JSON put path into a
+// prompb.WriteRequest, turning the metric name and tags into labels.
+func toWriteRequest(samples []PutSample) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(samples)),
+	}
+	for _, s := range samples {
+		labels := make([]prompb.Label, 0, len(s.Tags)+1)
+		labels = append(labels, prompb.Label{Name: "__name__", Value: s.Metric})
+		for k, v := range s.Tags {
+			labels = append(labels, prompb.Label{Name: k, Value: v})
+		}
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels: labels,
+			Samples: []prompb.Sample{
+				{Value: s.Value, Timestamp: s.TimeStamp},
+			},
+		})
+	}
+	return req
+}
+
+// postRemoteWrite snappy-compresses a prompb.WriteRequest and posts it to url
+// with the headers required by the remote_write protocol. It returns the
+// number of bytes actually put on the wire (the compressed body) so the
+// caller can feed press_bytes_sent_total the same way it does for the put
+// path.
+func postRemoteWrite(client *http.Client, url string, samples []PutSample) (int, error) {
+	req := toWriteRequest(samples)
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return 0, fmt.Errorf("marshal write request: %w", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(compressed))
+	if err != nil {
+		return 0, fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("post remote_write request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("remote_write post failed with status %s", resp.Status)
+	}
+	return len(compressed), nil
+}
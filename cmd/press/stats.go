@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runStats accumulates per-request latencies and outcome counts over a press
+// run so a human-readable summary can be printed once it completes.
+type runStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	samplesOK int64
+	errors    int64
+}
+
+func (s *runStats) record(d time.Duration, samples int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies = append(s.latencies, d)
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.samplesOK += int64(samples)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p / 100 * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// report prints the achieved rate, error rate and p50/p95/p99 latency for a
+// run that lasted elapsed.
+func (s *runStats) report(elapsed time.Duration) {
+	s.mu.Lock()
+	sorted := make([]time.Duration, len(s.latencies))
+	copy(sorted, s.latencies)
+	samplesOK, errs := s.samplesOK, s.errors
+	s.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// record appends one latency per request, failed or not.
+	total := int64(len(sorted))
+	var errRate float64
+	if total > 0 {
+		errRate = float64(errs) / float64(total)
+	}
+	achieved := float64(samplesOK) / elapsed.Seconds()
+
+	fmt.Printf("press summary: duration=%s achieved_rate=%.1f points/sec error_rate=%.4f p50=%s p95=%s p99=%s\n",
+		elapsed.Round(time.Second), achieved, errRate,
+		percentile(sorted, 50), percentile(sorted, 95), percentile(sorted, 99))
+}
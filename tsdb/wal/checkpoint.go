@@ -0,0 +1,152 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// checkpointFilename is the name of the file that records the LSN passed to
+// the most recent successful Checkpoint call, directly under the WAL dir.
+const checkpointFilename = "checkpoint"
+
+// segmentOfLSN and offsetOfLSN pick apart an LSN as packed by WAL.lsn:
+// segment index in the upper 32 bits, byte offset within that segment in
+// the lower 32 bits.
+func segmentOfLSN(lsn uint64) int {
+	return int(lsn >> 32)
+}
+
+func offsetOfLSN(lsn uint64) int64 {
+	return int64(lsn & 0xffffffff)
+}
+
+// Checkpoint records lsn as the last durably-applied point in the WAL's
+// checkpoint file, then truncates every segment lsn's segment has fully
+// superseded. It deliberately leaves lsn's own segment alone, since records
+// after lsn in it may not have been applied yet.
+//
+// Checkpoint says nothing about whether lsn itself was fsynced to disk;
+// pair it with an Always or GroupCommit SyncPolicy if callers need that
+// guarantee too.
+func (w *WAL) Checkpoint(lsn uint64) error {
+	if err := writeCheckpoint(w.dir, lsn); err != nil {
+		return errors.Wrap(err, "write checkpoint")
+	}
+	w.checkpoint = lsn
+	w.metrics.checkpointTotal.Inc()
+	w.metrics.checkpointLSN.Set(float64(lsn))
+	return w.Truncate(segmentOfLSN(lsn))
+}
+
+// LastCheckpoint returns the LSN recorded by the most recent Checkpoint
+// call, loaded from disk when the WAL was opened. It is 0 if dir has never
+// been checkpointed.
+func (w *WAL) LastCheckpoint() (uint64, error) {
+	return w.checkpoint, nil
+}
+
+// writeCheckpoint atomically replaces dir's checkpoint file with one
+// recording lsn.
+func writeCheckpoint(dir string, lsn uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], lsn)
+
+	fn := filepath.Join(dir, checkpointFilename)
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf[:], 0666); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
+
+// readCheckpoint returns the LSN recorded in dir's checkpoint file, or 0 if
+// dir has no checkpoint file yet.
+func readCheckpoint(dir string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, checkpointFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, errors.Errorf("invalid checkpoint file %s: expected 8 bytes, got %d", checkpointFilename, len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// CheckpointedReader wraps a Reader over a WAL's segments, already
+// positioned so that the first call to Next() returns the first record
+// with an LSN greater than the checkpoint it was opened at.
+type CheckpointedReader struct {
+	*Reader
+	queued bool // true if skip() already advanced to a record the caller hasn't consumed yet.
+	eof    bool // true if skip() found nothing beyond the checkpoint.
+}
+
+// Next advances to the next record beyond the checkpoint, accounting for
+// the one record (if any) skip() already had to read to find it.
+func (r *CheckpointedReader) Next() bool {
+	if r.queued {
+		r.queued = false
+		return true
+	}
+	if r.eof {
+		return false
+	}
+	return r.Reader.Next()
+}
+
+// Reader returns a CheckpointedReader over every segment from the WAL's
+// last checkpoint onward, having already skipped every record at or before
+// that checkpoint's LSN.
+func (w *WAL) Reader() (*CheckpointedReader, error) {
+	return w.readerFrom(w.checkpoint)
+}
+
+// readerFrom returns a CheckpointedReader over every segment from after's
+// segment onward, having already skipped every record at or before the LSN
+// after. Follower reuses this to rebuild its reader each time it picks up
+// segments created since the last one it knew about.
+func (w *WAL) readerFrom(after uint64) (*CheckpointedReader, error) {
+	rc, err := NewSegmentsRangeReader(SegmentRange{Dir: w.dir, First: segmentOfLSN(after), Last: -1})
+	if err != nil {
+		return nil, errors.Wrap(err, "open segments reader")
+	}
+	cr := &CheckpointedReader{Reader: NewReader(rc)}
+	if after == 0 {
+		return cr, nil
+	}
+
+	for cr.Reader.Next() {
+		lsn := uint64(cr.Reader.Segment())<<32 | uint64(cr.Reader.Offset())
+		if lsn > after {
+			cr.queued = true
+			return cr, nil
+		}
+	}
+	if err := cr.Reader.Err(); err != nil {
+		return nil, errors.Wrap(err, "skip to position")
+	}
+	cr.eof = true
+	return cr, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// codecID is the value a RecordCodec's flag is expected to carry: it's
+// stored in the 4 codec-id bits of the record header (see the header layout
+// comment above recTypeMask in wal.go) so Reader can tell which codec to
+// hand a compressed record to without any out-of-band configuration.
+type codecID byte
+
+const (
+	codecNone   codecID = 0 // No codec bits set; the legacy snappyMask bit decides instead.
+	codecSnappy codecID = 1 // Reserved: same algorithm as the legacy snappyMask bit.
+	codecZstd   codecID = 2
+	codecLZ4    codecID = 3
+	codecS2     codecID = 4
+)
+
+// RecordCodec compresses and decompresses individual WAL records. Encode
+// reports the flag to store in the record header alongside the compressed
+// payload; Decode is handed that same flag back so it knows how to reverse
+// it. Implementations must round-trip exactly: Decode(Encode(x)) == x.
+type RecordCodec interface {
+	Encode(rec []byte) (out []byte, flag byte, err error)
+	Decode(flag byte, rec []byte) (out []byte, err error)
+}
+
+// codecs is the table Reader consults to decode a record whose header names
+// a codec id other than codecNone/codecSnappy, which are handled inline by
+// the legacy snappyMask path instead. Add an entry here for every RecordCodec
+// a WAL in this process might have written with.
+var codecs = map[byte]RecordCodec{
+	byte(codecZstd): zstdCodec{},
+	byte(codecLZ4):  lz4Codec{},
+	byte(codecS2):   s2Codec{},
+}
+
+// codecByID looks up a registered codec for flag, the codec-id bits read
+// back out of a record header.
+func codecByID(flag byte) (RecordCodec, bool) {
+	c, ok := codecs[flag]
+	return c, ok
+}
+
+// RegisterCodec makes codec available to every Reader in this process under
+// id, the value it must report as the flag byte from Encode. It panics if
+// id collides with codecNone, codecSnappy (both reserved for the legacy
+// snappyMask path) or an already-registered codec, since a silent overwrite
+// would change how existing WAL segments decode out from under whatever
+// registered the original.
+//
+// Call it from an init function before any WAL in the process opens, since
+// a record written with a codec unknown to the Reader that later reads it
+// back fails with "unknown wal record codec".
+func RegisterCodec(id byte, codec RecordCodec) {
+	if id == byte(codecNone) || id == byte(codecSnappy) {
+		panic("wal: codec id is reserved for the legacy snappy path")
+	}
+	if _, exists := codecs[id]; exists {
+		panic("wal: codec id already registered")
+	}
+	codecs[id] = codec
+}
+
+// zstdCodec trades CPU for ratio; a good fit for archival WALs on slow disks.
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(rec []byte) ([]byte, byte, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, byte(codecZstd), errors.Wrap(err, "new zstd encoder")
+	}
+	defer enc.Close()
+	return enc.EncodeAll(rec, make([]byte, 0, len(rec))), byte(codecZstd), nil
+}
+
+func (zstdCodec) Decode(_ byte, rec []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "new zstd decoder")
+	}
+	defer dec.Close()
+	return dec.DecodeAll(rec, nil)
+}
+
+// lz4Codec trades ratio for CPU; a good fit for ingest-heavy setups where the
+// WAL is the bottleneck.
+type lz4Codec struct{}
+
+func (lz4Codec) Encode(rec []byte) ([]byte, byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	if _, err := w.Write(rec); err != nil {
+		return nil, byte(codecLZ4), errors.Wrap(err, "lz4 compress")
+	}
+	if err := w.Close(); err != nil {
+		return nil, byte(codecLZ4), errors.Wrap(err, "lz4 compress")
+	}
+	return buf.Bytes(), byte(codecLZ4), nil
+}
+
+func (lz4Codec) Decode(_ byte, rec []byte) ([]byte, error) {
+	out, err := ioutil.ReadAll(lz4.NewReader(bytes.NewReader(rec)))
+	if err != nil {
+		return nil, errors.Wrap(err, "lz4 decompress")
+	}
+	return out, nil
+}
+
+// s2Codec is the snappy-framed successor: same decode cost class as plain
+// snappy but substantially higher encode throughput, at a similar ratio. A
+// good fit when WAL writes are CPU-bound on compression rather than disk.
+type s2Codec struct{}
+
+func (s2Codec) Encode(rec []byte) ([]byte, byte, error) {
+	return s2.Encode(nil, rec), byte(codecS2), nil
+}
+
+func (s2Codec) Decode(_ byte, rec []byte) ([]byte, error) {
+	out, err := s2.Decode(nil, rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "s2 decompress")
+	}
+	return out, nil
+}
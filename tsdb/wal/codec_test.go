@@ -0,0 +1,122 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRecordCodecsRoundTrip checks that every built-in codec's Decode
+// reverses its own Encode exactly, across an empty record, a short one and a
+// large repetitive one, since Reader relies on that invariant to hand a compressed record
+// back to the caller unchanged.
+func TestRecordCodecsRoundTrip(t *testing.T) {
+	recs := [][]byte{
+		[]byte(""),
+		[]byte("a single short record"),
+		bytes.Repeat([]byte("0123456789"), 1000),
+	}
+
+	for flag, codec := range codecs {
+		for _, rec := range recs {
+			enc, gotFlag, err := codec.Encode(rec)
+			if err != nil {
+				t.Fatalf("codec %d: encode: %v", flag, err)
+			}
+			if gotFlag != flag {
+				t.Fatalf("codec %d: Encode reported flag %d", flag, gotFlag)
+			}
+
+			dec, err := codec.Decode(gotFlag, enc)
+			if err != nil {
+				t.Fatalf("codec %d: decode: %v", flag, err)
+			}
+			if !bytes.Equal(dec, rec) {
+				t.Fatalf("codec %d: round trip mismatch: got %q, want %q", flag, dec, rec)
+			}
+		}
+	}
+}
+
+// TestCodecByID checks that every built-in codec is reachable through the
+// same lookup Reader uses to decode a record, and that an unregistered id
+// is reported as such rather than silently returning a zero-value codec.
+func TestCodecByID(t *testing.T) {
+	for id := range codecs {
+		c, ok := codecByID(id)
+		if !ok || c == nil {
+			t.Fatalf("codecByID(%d) = %v, %v; want a registered codec", id, c, ok)
+		}
+	}
+
+	if _, ok := codecByID(byte(codecS2) + 100); ok {
+		t.Fatalf("codecByID of an unregistered id reported ok")
+	}
+}
+
+// fakeCodec is a minimal RecordCodec used only to exercise RegisterCodec's
+// validation without pulling in a real compression library. Its flag is 200,
+// the id TestRegisterCodec registers it under.
+type fakeCodec struct{}
+
+func (fakeCodec) Encode(rec []byte) ([]byte, byte, error)   { return rec, 200, nil }
+func (fakeCodec) Decode(_ byte, rec []byte) ([]byte, error) { return rec, nil }
+
+func TestRegisterCodec(t *testing.T) {
+	mustPanic := func(t *testing.T, name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expected panic", name)
+			}
+		}()
+		fn()
+	}
+
+	t.Run("reserved ids panic", func(t *testing.T) {
+		mustPanic(t, "codecNone", func() { RegisterCodec(byte(codecNone), fakeCodec{}) })
+		mustPanic(t, "codecSnappy", func() { RegisterCodec(byte(codecSnappy), fakeCodec{}) })
+	})
+
+	t.Run("duplicate id panics", func(t *testing.T) {
+		mustPanic(t, "codecZstd", func() { RegisterCodec(byte(codecZstd), fakeCodec{}) })
+	})
+
+	t.Run("new id is reachable afterwards", func(t *testing.T) {
+		const id = byte(200)
+		if _, ok := codecByID(id); ok {
+			t.Fatalf("precondition: id %d must not already be registered", id)
+		}
+
+		RegisterCodec(id, fakeCodec{})
+		c, ok := codecByID(id)
+		if !ok {
+			t.Fatalf("codecByID(%d) not found after RegisterCodec", id)
+		}
+
+		enc, flag, err := c.Encode([]byte("x"))
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		dec, err := c.Decode(flag, enc)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if string(dec) != "x" {
+			t.Fatalf("got %q, want %q", dec, "x")
+		}
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"sync"
+)
+
+// followState lets a Follower block for new writes instead of polling the
+// directory and re-running listSegments, mirroring the groupCommitState
+// pattern in syncpolicy.go: one sync.Cond broadcasts the new high-water LSN
+// to every follower blocked waiting for data past it.
+type followState struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	lsn    uint64
+	closed bool
+}
+
+func newFollowState() *followState {
+	s := &followState{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// notify records lsn as the new high-water mark, if it advances the
+// previous one, and wakes every follower waiting on it.
+func (s *followState) notify(lsn uint64) {
+	s.mu.Lock()
+	if lsn > s.lsn {
+		s.lsn = lsn
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// shutdown wakes every blocked follower for good, e.g. once the WAL closes.
+func (s *followState) shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// wait blocks until the high-water LSN advances past after, or the WAL
+// shuts down, then reports whether the WAL is still open.
+func (s *followState) wait(after uint64) (open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.lsn <= after && !s.closed {
+		s.cond.Wait()
+	}
+	return !s.closed
+}
+
+// Record is one entry delivered by a Follower, tagged with the LSN it was
+// written at so a consumer can pass it straight to WAL.Checkpoint once
+// applied.
+type Record struct {
+	LSN  uint64
+	Data []byte
+}
+
+// Follower streams records appended to a WAL from some starting LSN onward,
+// blocking for new writes instead of returning EOF at the end of the active
+// segment — the primitive remote-write, exemplar replication and external
+// WAL shippers need in order to stop polling the directory and re-running
+// listSegments in a loop. Obtain one with WAL.Tail; call Close when done.
+type Follower struct {
+	recs chan Record
+	errc chan error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Records returns the channel new records are delivered on, in LSN order.
+// It is closed once the follower stops, whether from Close, ctx, or an
+// error delivered on Errs.
+func (f *Follower) Records() <-chan Record { return f.recs }
+
+// Errs delivers at most one error — a read corruption or ctx.Err() — and is
+// closed alongside Records.
+func (f *Follower) Errs() <-chan error { return f.errc }
+
+// Close stops the follower's background goroutine and waits for it to exit.
+// Safe to call more than once.
+func (f *Follower) Close() {
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	<-f.done
+}
+
+// Tail returns a Follower delivering every record written at an LSN greater
+// than fromLSN, including ones written after Tail is called. chanSize bounds
+// how far the follower may run ahead of a slow consumer before it blocks
+// the follower's own goroutine (backpressure); it does not block Log().
+func (w *WAL) Tail(ctx context.Context, fromLSN uint64, chanSize int) (*Follower, error) {
+	if chanSize <= 0 {
+		chanSize = 1
+	}
+	f := &Follower{
+		recs: make(chan Record, chanSize),
+		errc: make(chan error, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go f.run(ctx, w, fromLSN)
+	return f, nil
+}
+
+// run replays records from after onward until ctx is cancelled, Close is
+// called, or the WAL is closed. The active segment just grows in place, so
+// once cr catches up to it run keeps reusing the same cr — picking up newly
+// appended records straight off the same open file — and only rebuilds it
+// with readerFrom (the same skip-to-LSN logic WAL.Reader uses for
+// checkpoints) when a new segment has actually been created since cr was
+// opened. Either way, whatever cr was open when run exits gets closed.
+func (f *Follower) run(ctx context.Context, w *WAL, after uint64) {
+	defer close(f.done)
+	defer close(f.recs)
+	defer close(f.errc)
+
+	cr, err := w.readerFrom(after)
+	if err != nil {
+		f.errc <- err
+		return
+	}
+	defer func() { cr.Close() }()
+	// Block for more bytes instead of zero-padding past the tail of the
+	// active segment, which cr is about to start tailing: see
+	// segmentBufReader.waitForMore. The closure captures after by reference,
+	// so it sees every reassignment below without needing a pointer.
+	cr.enableFollowWait(func() bool { return w.follow.wait(after) })
+
+	for {
+		for cr.Next() {
+			lsn := uint64(cr.Segment())<<32 | uint64(cr.Offset())
+			select {
+			case f.recs <- Record{LSN: lsn, Data: append([]byte(nil), cr.Record()...)}:
+			case <-f.stop:
+				return
+			case <-ctx.Done():
+				f.errc <- ctx.Err()
+				return
+			}
+			after = lsn
+		}
+		if err := cr.Err(); err != nil {
+			f.errc <- err
+			return
+		}
+
+		if open := w.follow.wait(after); !open {
+			return
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-ctx.Done():
+			f.errc <- ctx.Err()
+			return
+		default:
+		}
+
+		// Only rebuild the reader — and re-scan the directory — when a
+		// new segment has actually shown up since cr was opened. Short of
+		// that, cr's own segment file just grew, and cr.Next() above
+		// already picks that up for free.
+		if _, last, err := w.Segments(); err == nil && last > cr.lastOpenSegment() {
+			next, err := w.readerFrom(after)
+			if err != nil {
+				f.errc <- err
+				return
+			}
+			next.enableFollowWait(func() bool { return w.follow.wait(after) })
+			cr.Close()
+			cr = next
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// decodeRecord decompresses payload per the codec flag / legacy compressed
+// bit read from a record's header. It is the same logic Reader.next applies
+// inline; ParallelReader's workers call it instead, off the read+CRC path.
+func decodeRecord(codecFlag byte, compressed bool, payload []byte) ([]byte, error) {
+	switch {
+	case codecFlag != 0 && codecFlag != byte(codecSnappy):
+		codec, ok := codecByID(codecFlag)
+		if !ok {
+			return nil, errors.Errorf("unknown wal record codec %d", codecFlag)
+		}
+		return codec.Decode(codecFlag, payload)
+	case (compressed || codecFlag == byte(codecSnappy)) && len(payload) > 0:
+		n, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		return snappy.Decode(make([]byte, n), payload)
+	default:
+		return payload, nil
+	}
+}
+
+// parallelJob is one record payload handed from the read+CRC-validate
+// goroutine to a decode worker, tagged with a sequence number so
+// ParallelReader.Next can deliver results in the original order regardless
+// of which worker finishes first, and with the segment/offset it was read
+// at so a successfully-decoded record can still be attributed correctly.
+// err is set instead when the read+validate stage itself failed on this
+// sequence number; workers pass it straight through without decoding.
+type parallelJob struct {
+	seq        uint64
+	segment    int
+	offset     int64
+	payload    []byte
+	codecFlag  byte
+	compressed bool
+	err        error
+}
+
+type parallelResult struct {
+	seq     uint64
+	segment int
+	offset  int64
+	rec     []byte
+	err     error
+}
+
+// ParallelReader is a drop-in replacement for Reader that overlaps record
+// decompression with reading: one goroutine reads pages and validates CRCs
+// exactly like Reader.next does, a pool of workers decompresses payloads
+// concurrently, and Next delivers them back in their original order through
+// a small reorder buffer keyed by sequence number. It exists for replay
+// paths such as tsdb.Head.loadWAL, where decompression competes with disk
+// I/O for the hot loop's time.
+type ParallelReader struct {
+	results <-chan parallelResult
+	pending map[uint64]parallelResult
+	nextSeq uint64
+
+	rec     []byte
+	segment int
+	offset  int64
+	err     error
+}
+
+// NewParallelReader returns a ParallelReader over r using workers decode
+// goroutines (clamped to at least 1). It reports corruption the same way
+// Reader does: Err() returns a *CorruptionErr naming the segment and offset
+// the read+CRC-validate goroutine was at when it gave up.
+func NewParallelReader(r io.Reader, workers int) *ParallelReader {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	jobs := make(chan parallelJob, workers)
+	results := make(chan parallelResult, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if job.err != nil {
+					results <- parallelResult{seq: job.seq, err: job.err}
+					continue
+				}
+				rec, err := decodeRecord(job.codecFlag, job.compressed, job.payload)
+				results <- parallelResult{seq: job.seq, segment: job.segment, offset: job.offset, rec: rec, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	rawR := NewReader(r)
+	rawR.rawMode = true
+	go produceParallelJobs(rawR, jobs)
+
+	return &ParallelReader{
+		results: results,
+		pending: make(map[uint64]parallelResult),
+	}
+}
+
+// produceParallelJobs drives rawR sequentially — reading pages, validating
+// CRCs and assembling each record's (possibly still compressed) payload,
+// exactly as Reader.next does — and turns each one into a parallelJob.
+// Payloads are copied out since rawR reuses its internal buffers on the
+// next Next() call.
+func produceParallelJobs(rawR *Reader, jobs chan<- parallelJob) {
+	defer close(jobs)
+	var seq uint64
+	for rawR.Next() {
+		payload, codecFlag, compressed := rawR.rawPayload()
+		jobs <- parallelJob{
+			seq:        seq,
+			segment:    rawR.Segment(),
+			offset:     rawR.Offset(),
+			payload:    append([]byte(nil), payload...),
+			codecFlag:  codecFlag,
+			compressed: compressed,
+		}
+		seq++
+	}
+	if err := rawR.Err(); err != nil {
+		jobs <- parallelJob{seq: seq, err: err}
+	}
+}
+
+// Next advances to the next record, blocking until the decode worker
+// assigned to it (or all of them, if this record arrives out of order)
+// finishes. It must not be called again after it returned false.
+func (p *ParallelReader) Next() bool {
+	for {
+		if res, ok := p.pending[p.nextSeq]; ok {
+			delete(p.pending, p.nextSeq)
+			return p.deliver(res)
+		}
+		res, ok := <-p.results
+		if !ok {
+			return false
+		}
+		if res.seq == p.nextSeq {
+			return p.deliver(res)
+		}
+		p.pending[res.seq] = res
+	}
+}
+
+func (p *ParallelReader) deliver(res parallelResult) bool {
+	p.nextSeq++
+	if res.err != nil {
+		p.err = res.err
+		return false
+	}
+	p.rec, p.segment, p.offset = res.rec, res.segment, res.offset
+	return true
+}
+
+// Err returns the last encountered error, already wrapped in a
+// *CorruptionErr by the underlying Reader that hit it.
+func (p *ParallelReader) Err() error { return p.err }
+
+// Record returns the current record. The returned byte slice is only valid
+// until the next call to Next.
+func (p *ParallelReader) Record() []byte { return p.rec }
+
+// Segment returns the current segment being read.
+func (p *ParallelReader) Segment() int { return p.segment }
+
+// Offset returns the current position of the segment being read.
+func (p *ParallelReader) Offset() int64 { return p.offset }
@@ -0,0 +1,310 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// RepairMode selects how RepairWithOptions handles the data it finds after
+// a corruption.
+type RepairMode int
+
+const (
+	// TruncateAfter discards every record from the corruption's offset
+	// onward. This is the historical Repair behavior: safe, but it throws
+	// away anything written after the tear even if later records in the
+	// segment are intact.
+	TruncateAfter RepairMode = iota
+	// SkipTorn discards only the record(s) immediately around each tear it
+	// finds in the corrupted segment: scanning resumes at the next
+	// recFull/recFirst found on a later page boundary, preserving any intact
+	// records found after it in that segment. Segments after the corrupted
+	// one are still deleted, the same as under TruncateAfter.
+	SkipTorn
+)
+
+// RepairOptions configures RepairWithOptions.
+type RepairOptions struct {
+	// Mode selects how records after a detected tear are handled.
+	Mode RepairMode
+	// ScanWorkers, if > 0, has RepairWithOptions independently verify every
+	// segment in the WAL's directory across up to this many goroutines
+	// before repairing, rather than trusting only the originally reported
+	// CorruptionErr — useful since torn writes don't always surface on the
+	// first read of a segment. 0 skips the pre-scan and repairs exactly the
+	// position origErr reported, matching Repair's historical behavior.
+	ScanWorkers int
+}
+
+// Repair attempts to repair the WAL based on the error, discarding all data
+// from the corruption onward. It is equivalent to
+// RepairWithOptions(origErr, RepairOptions{Mode: TruncateAfter}).
+func (w *WAL) Repair(origErr error) error {
+	return w.RepairWithOptions(origErr, RepairOptions{Mode: TruncateAfter})
+}
+
+// RepairWithOptions attempts to repair the WAL based on the error, per the
+// behavior selected by opts.Mode.
+// 传入错误信息尝试修复在数据读取过程中的数据错误
+func (w *WAL) RepairWithOptions(origErr error, opts RepairOptions) error {
+	// 取出错误信息
+	err := errors.Cause(origErr) // So that we can pick up errors even if wrapped.
+
+	cerr, ok := err.(*CorruptionErr)
+	if !ok {
+		return errors.Wrap(origErr, "cannot handle error")
+	}
+	if cerr.Segment < 0 {
+		return errors.New("corruption error does not specify position")
+	}
+
+	if opts.ScanWorkers > 0 {
+		if found, serr := ScanSegments(w.dir, opts.ScanWorkers); serr != nil {
+			level.Warn(w.logger).Log("msg", "parallel segment scan failed, repairing only the reported corruption", "err", serr)
+		} else {
+			// Prefer whatever corruption the scan found earliest in the log
+			// over the one origErr reported, in case origErr's reader gave
+			// up before reaching it.
+			for _, c := range found {
+				if c.Segment < cerr.Segment || (c.Segment == cerr.Segment && c.Offset < cerr.Offset) {
+					cerr = c
+				}
+			}
+		}
+	}
+
+	level.Warn(w.logger).Log("msg", "Starting corruption repair",
+		"segment", cerr.Segment, "offset", cerr.Offset, "mode", opts.Mode)
+
+	// All segments behind the corruption can no longer be used.
+	// 列出目录下面的所有的segment文件名称和id,返回的是有序的
+	segs, err := listSegments(w.dir)
+	if err != nil {
+		return errors.Wrap(err, "list segments")
+	}
+
+	level.Warn(w.logger).Log("msg", "Deleting all segments newer than corrupted segment", "segment", cerr.Segment)
+
+	// 遍历每个segment,然后做两个事情
+	// 1.关闭最近活跃中的Segment  2.删除超前的Segment
+	for _, s := range segs {
+		// 把当前活跃的segment关闭
+		if w.segment.i == s.index {
+			// The active segment needs to be removed,
+			// close it first (Windows!). Can be closed safely
+			// as we set the current segment to repaired file
+			// below.
+			if err := w.segment.Close(); err != nil {
+				return errors.Wrap(err, "close active segment")
+			}
+		}
+		// 异常的segment 小于等于当前活跃的，不用处理
+		if s.index <= cerr.Segment {
+			continue
+		}
+
+		// 删除超前的segment
+		// 什么情况下会有这种超前的Segment呢？？
+		if err := os.Remove(filepath.Join(w.dir, s.name)); err != nil {
+			return errors.Wrapf(err, "delete segment:%v", s.index)
+		}
+	}
+
+	// 修复后的文件名 .repair
+	fn := SegmentName(w.dir, cerr.Segment)
+	tmpfn := fn + ".repair"
+
+	// 把损坏的文件改一个名字
+	if err := fileutil.Rename(fn, tmpfn); err != nil {
+		return err
+	}
+
+	// Create a clean segment and make it the active one.
+	// 创建一个新的Segment
+	s, err := CreateSegment(w.dir, cerr.Segment)
+	if err != nil {
+		return err
+	}
+	if err := w.setSegment(s); err != nil {
+		return err
+	}
+
+	// 打开老的损坏的那个Segment
+	f, err := os.Open(tmpfn)
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+	defer f.Close()
+
+	r := NewReader(bufio.NewReader(f))
+
+	var dropped, preserved int
+	switch opts.Mode {
+	case SkipTorn:
+		// Keep replaying past every tear it finds, rather than stopping at
+		// the first one, so records after a tear aren't discarded unless
+		// they're torn themselves too.
+		for {
+			for r.Next() {
+				if err := w.Log(r.Record()); err != nil {
+					return errors.Wrap(err, "insert record")
+				}
+				preserved++
+			}
+			if r.Err() == nil {
+				break // Reached a clean EOF; nothing left to recover.
+			}
+			if !r.Recover() {
+				break
+			}
+			dropped++
+		}
+	default: // TruncateAfter
+		for r.Next() {
+			// Add records only up to where the error was.
+			if r.Offset() >= cerr.Offset {
+				break
+			}
+			if err := w.Log(r.Record()); err != nil {
+				return errors.Wrap(err, "insert record")
+			}
+			preserved++
+		}
+		// We expect an error here from r.Err(), so nothing to handle.
+	}
+	w.metrics.repairRecordsPreserved.Add(float64(preserved))
+	w.metrics.repairRecordsDropped.Add(float64(dropped))
+
+	// We need to pad to the end of the last page in the repaired segment
+	// 刷出数据
+	if err := w.flushPage(true); err != nil {
+		return errors.Wrap(err, "flush page in repair")
+	}
+
+	// We explicitly close even when there is a defer for Windows to be
+	// able to delete it. The defer is in place to close it in-case there
+	// are errors above.
+	// 关闭和清理错误的Segment
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close corrupted file")
+	}
+	if err := os.Remove(tmpfn); err != nil {
+		return errors.Wrap(err, "delete corrupted segment")
+	}
+
+	// Explicitly close the segment we just repaired to avoid issues with Windows.
+	s.Close()
+
+	//我们始终希望开始写入新的细分，而不是现有的细分
+	//段，该段由NewSize处理，但在修复之前，我们要删除
+	//损坏的细分之后的所有细分。 在此处重新创建一个新的细分。
+	s, err = CreateSegment(w.dir, cerr.Segment+1)
+	if err != nil {
+		return err
+	}
+	if err := w.setSegment(s); err != nil {
+		return err
+	}
+	invalidateSegmentCacheFrom(w.dir, cerr.Segment)
+	return nil
+}
+
+// ScanSegments independently verifies every segment in dir — CRC, record
+// type transitions and the recPageTerm invariant — spreading the work
+// across up to workers goroutines, rather than only trusting whatever
+// CorruptionErr a previous sequential read happened to report. It returns
+// one CorruptionErr per segment where a problem was found, ordered by
+// segment index; a nil, nil result means dir is clean.
+func ScanSegments(dir string, workers int) ([]*CorruptionErr, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(refs) {
+		workers = len(refs)
+	}
+
+	jobs := make(chan segmentRef)
+	type scanResult struct {
+		cerr *CorruptionErr
+		err  error
+	}
+	results := make(chan scanResult, len(refs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range jobs {
+				cerr, err := scanSegment(dir, ref)
+				results <- scanResult{cerr, err}
+			}
+		}()
+	}
+	for _, ref := range refs {
+		jobs <- ref
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	var found []*CorruptionErr
+	for res := range results {
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.cerr != nil {
+			found = append(found, res.cerr)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Segment < found[j].Segment })
+	return found, nil
+}
+
+// scanSegment reads one segment end-to-end, validating every record, and
+// reports the first corruption it hits, if any.
+func scanSegment(dir string, ref segmentRef) (*CorruptionErr, error) {
+	s, err := OpenReadSegment(filepath.Join(dir, ref.name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open segment %v", ref.name)
+	}
+	defer s.Close()
+
+	r := NewReader(bufio.NewReader(s))
+	for r.Next() {
+	}
+	if err := r.Err(); err != nil {
+		return &CorruptionErr{
+			Dir:     dir,
+			Segment: ref.index,
+			Offset:  r.Offset(),
+			Err:     err,
+		}, nil
+	}
+	return nil, nil
+}
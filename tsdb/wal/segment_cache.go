@@ -0,0 +1,258 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReaderOptions configures NewSegmentsRangeReaderWithOptions.
+type ReaderOptions struct {
+	// SegmentCacheSize is the number of most-recently-read closed segments
+	// to keep fully buffered in memory, shared across readers of the same
+	// directory. 0 (the zero value) disables the cache.
+	SegmentCacheSize int
+	// Registerer receives the segment cache's hit/miss/bytes metrics the
+	// first time SegmentCacheSize enables a cache for a given directory, the
+	// same way callers pass a Registerer into NewSizeWithOptions for the
+	// rest of the package's metrics. Nil skips registration, matching
+	// newWALMetrics' nil-Registerer behavior.
+	Registerer prometheus.Registerer
+}
+
+// defaultReaderOptions matches the un-cached behavior of NewSegmentsRangeReader.
+var defaultReaderOptions = ReaderOptions{SegmentCacheSize: 0}
+
+// Shared across every segmentCache instance (one per WAL directory), labeled
+// by directory so hits/misses/bytes can be told apart per WAL when several
+// are open in the same process. Registered against the Registerer passed in
+// via ReaderOptions the first time a cache is created, rather than against
+// prometheus's global default registry, so a caller using an independent
+// registry (tests, multi-tenant embedding) still sees them.
+var (
+	segmentCacheRegisterMu sync.Mutex
+	segmentCacheRegistered = map[prometheus.Registerer]bool{}
+	segmentCacheHits       = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_segment_cache_hits_total",
+		Help: "Total number of WAL segment cache hits.",
+	}, []string{"dir"})
+	segmentCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_segment_cache_misses_total",
+		Help: "Total number of WAL segment cache misses.",
+	}, []string{"dir"})
+	segmentCacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_wal_segment_cache_bytes",
+		Help: "Total bytes currently held by the WAL segment cache.",
+	}, []string{"dir"})
+)
+
+// registerSegmentCacheMetrics registers the segment cache metrics against
+// reg, once per distinct Registerer: segmentCacheFor is called once per WAL
+// directory, so without tracking which Registerers already have it, a
+// second directory sharing the same Registerer would hit MustRegister's
+// "already registered" panic, while a sync.Once (only ever firing for the
+// first Registerer seen) would leave every independent registry after the
+// first with no metrics at all.
+func registerSegmentCacheMetrics(reg prometheus.Registerer) {
+	if reg == nil {
+		return
+	}
+	segmentCacheRegisterMu.Lock()
+	defer segmentCacheRegisterMu.Unlock()
+	if segmentCacheRegistered[reg] {
+		return
+	}
+	reg.MustRegister(segmentCacheHits, segmentCacheMisses, segmentCacheBytes)
+	segmentCacheRegistered[reg] = true
+}
+
+type cachedSegment struct {
+	index int
+	data  []byte
+}
+
+// segmentCache is a bounded LRU of fully-buffered closed segments for one
+// WAL directory, shared by every reader of that directory so repeated
+// re-scans (remote-write tailers, repair, checkpointing) don't re-stream the
+// same bytes off disk every time. It's safe for concurrent use.
+type segmentCache struct {
+	mu       sync.RWMutex
+	size     int
+	order    []int // segment indexes, most-recently-used last
+	segments map[int]*cachedSegment
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+	bytes  prometheus.Gauge
+}
+
+func newSegmentCache(dir string, size int) *segmentCache {
+	return &segmentCache{
+		size:     size,
+		segments: make(map[int]*cachedSegment),
+		hits:     segmentCacheHits.WithLabelValues(dir),
+		misses:   segmentCacheMisses.WithLabelValues(dir),
+		bytes:    segmentCacheBytes.WithLabelValues(dir),
+	}
+}
+
+func (c *segmentCache) get(index int) ([]byte, bool) {
+	c.mu.RLock()
+	seg, ok := c.segments[index]
+	c.mu.RUnlock()
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	c.touch(index)
+	return seg.data, true
+}
+
+func (c *segmentCache) touch(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, idx := range c.order {
+		if idx == index {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, index)
+}
+
+func (c *segmentCache) put(index int, data []byte) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.segments[index]; exists {
+		return
+	}
+	c.segments[index] = &cachedSegment{index: index, data: data}
+	c.order = append(c.order, index)
+	c.bytes.Add(float64(len(data)))
+
+	for len(c.order) > c.size {
+		evict := c.order[0]
+		c.order = c.order[1:]
+		if seg, ok := c.segments[evict]; ok {
+			c.bytes.Sub(float64(len(seg.data)))
+			delete(c.segments, evict)
+		}
+	}
+}
+
+// invalidateBefore drops every cached segment with index < upto. Used by
+// Truncate, which deletes those segment files from disk.
+func (c *segmentCache) invalidateBefore(upto int) {
+	c.invalidate(func(index int) bool { return index < upto })
+}
+
+// invalidateFrom drops every cached segment with index >= from. Used by
+// Repair, which rewrites or removes those segment files.
+func (c *segmentCache) invalidateFrom(from int) {
+	c.invalidate(func(index int) bool { return index >= from })
+}
+
+func (c *segmentCache) invalidate(match func(index int) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var kept []int
+	for _, index := range c.order {
+		if match(index) {
+			if seg, ok := c.segments[index]; ok {
+				c.bytes.Sub(float64(len(seg.data)))
+				delete(c.segments, index)
+			}
+			continue
+		}
+		kept = append(kept, index)
+	}
+	c.order = kept
+}
+
+// Process-wide registry of segment caches, one per WAL directory, so that
+// independent readers over the same directory (e.g. a tailer and a
+// checkpointer) share cache hits. Keyed by directory path, and itself
+// bounded by an LRU over directories (maxSegmentCacheDirs) the same way a
+// segmentCache bounds its segments, so a long-running process that opens
+// many distinct WAL directories (per-test tmp dirs, per-tenant WAL dirs)
+// doesn't grow this map forever.
+const maxSegmentCacheDirs = 64
+
+var (
+	segmentCachesMu      sync.Mutex
+	segmentCaches        = map[string]*segmentCache{}
+	segmentCacheDirOrder []string // directories, most-recently-used last
+)
+
+func segmentCacheFor(dir string, size int, reg prometheus.Registerer) *segmentCache {
+	registerSegmentCacheMetrics(reg)
+	segmentCachesMu.Lock()
+	defer segmentCachesMu.Unlock()
+
+	if c, ok := segmentCaches[dir]; ok {
+		touchSegmentCacheDirLocked(dir)
+		return c
+	}
+
+	c := newSegmentCache(dir, size)
+	segmentCaches[dir] = c
+	segmentCacheDirOrder = append(segmentCacheDirOrder, dir)
+	for len(segmentCacheDirOrder) > maxSegmentCacheDirs {
+		evict := segmentCacheDirOrder[0]
+		segmentCacheDirOrder = segmentCacheDirOrder[1:]
+		delete(segmentCaches, evict)
+	}
+	return c
+}
+
+// touchSegmentCacheDirLocked moves dir to the most-recently-used end of
+// segmentCacheDirOrder. Callers must hold segmentCachesMu.
+func touchSegmentCacheDirLocked(dir string) {
+	for i, d := range segmentCacheDirOrder {
+		if d == dir {
+			segmentCacheDirOrder = append(segmentCacheDirOrder[:i], segmentCacheDirOrder[i+1:]...)
+			break
+		}
+	}
+	segmentCacheDirOrder = append(segmentCacheDirOrder, dir)
+}
+
+// invalidateSegmentCacheBefore evicts cached segments for dir below upto. A
+// no-op if dir has no cache yet.
+func invalidateSegmentCacheBefore(dir string, upto int) {
+	segmentCachesMu.Lock()
+	c, ok := segmentCaches[dir]
+	segmentCachesMu.Unlock()
+	if ok {
+		c.invalidateBefore(upto)
+	}
+}
+
+// invalidateSegmentCacheFrom evicts cached segments for dir at or above from.
+// A no-op if dir has no cache yet.
+func invalidateSegmentCacheFrom(dir string, from int) {
+	segmentCachesMu.Lock()
+	c, ok := segmentCaches[dir]
+	segmentCachesMu.Unlock()
+	if ok {
+		c.invalidateFrom(from)
+	}
+}
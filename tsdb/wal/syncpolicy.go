@@ -0,0 +1,175 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// SyncPolicy controls when the WAL forces the active segment to stable
+// storage, beyond the fsync that already happens on segment rotation and
+// Close. The zero value of WAL uses Never, which is today's behavior: a
+// crash can lose whatever hasn't been rotated out yet.
+type SyncPolicy interface {
+	// name identifies the policy for the prometheus_tsdb_wal_sync_policy metric.
+	name() string
+}
+
+// Always fsyncs the active segment after every Log()/LogLSN() batch.
+type Always struct{}
+
+func (Always) name() string { return "always" }
+
+// Interval fsyncs the active segment on a fixed cadence via a background
+// goroutine, independent of how often Log() is called.
+type Interval time.Duration
+
+func (Interval) name() string { return "interval" }
+
+// Never disables any fsync beyond the one already performed on segment
+// rotation and Close.
+type Never struct{}
+
+func (Never) name() string { return "never" }
+
+// GroupCommit coalesces concurrent Log() callers behind a single fsync: the
+// first caller to arrive after the previous flush starts a timer for D, and
+// whichever happens first — N callers joining or D elapsing — triggers one
+// fsync that every joined caller waits on.
+type GroupCommit struct {
+	N int
+	D time.Duration
+}
+
+func (GroupCommit) name() string { return "group_commit" }
+
+// groupCommitState coordinates the callers coalesced by a GroupCommit policy.
+// Callers must not hold w.mtx while calling join, since join blocks until
+// its generation's fsync completes.
+type groupCommitState struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting int
+	gen     uint64
+	err     error
+	// segs is the set of segments this generation's joiners actually wrote
+	// into. A rotation mid-generation (one joiner's record landed in the
+	// segment before nextSegment ran, another's in the one after) would
+	// otherwise leave flush fsyncing only whichever segment is active by
+	// the time it runs, silently skipping the other.
+	segs map[*Segment]struct{}
+}
+
+func newGroupCommitState() *groupCommitState {
+	s := &groupCommitState{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// join enrolls the caller, and the segment its record was written into, in
+// the current fsync generation, and blocks until that generation's fsync
+// completes, returning its error (if any).
+func (s *groupCommitState) join(w *WAL, policy GroupCommit, seg *Segment) error {
+	s.mu.Lock()
+	gen := s.gen
+	if s.segs == nil {
+		s.segs = make(map[*Segment]struct{})
+	}
+	s.segs[seg] = struct{}{}
+	s.waiting++
+	if s.waiting == 1 {
+		time.AfterFunc(policy.D, func() { s.flush(w, gen) })
+	}
+	reachedN := s.waiting >= policy.N
+	s.mu.Unlock()
+
+	if reachedN {
+		s.flush(w, gen)
+	}
+
+	s.mu.Lock()
+	for s.gen == gen {
+		s.cond.Wait()
+	}
+	err := s.err
+	s.mu.Unlock()
+	return err
+}
+
+// flush fsyncs every segment generation gen's joiners wrote into, unless
+// another caller already did (the timer and the N-threshold can both fire
+// for the same generation), then wakes everyone waiting on it. s.mu is held
+// throughout, so no caller can join gen after its segments were captured and
+// then be released by an fsync that did not cover its write.
+func (s *groupCommitState) flush(w *WAL, gen uint64) {
+	s.mu.Lock()
+	if s.gen != gen {
+		s.mu.Unlock()
+		return
+	}
+
+	var err error
+	for seg := range s.segs {
+		if ferr := w.fsync(seg); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	w.metrics.groupCommitSize.Observe(float64(s.waiting))
+
+	s.err = err
+	s.segs = nil
+	s.waiting = 0
+	s.gen++
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// maybeSync applies w.syncPolicy after a batch of records has been written
+// to the active page. seg is the segment that batch was actually written
+// into, captured by the caller while w.mtx was still held, since w.segment
+// may have moved on to a new segment (nextSegment) by the time maybeSync
+// runs — maybeSync itself must be called without holding w.mtx.
+func (w *WAL) maybeSync(seg *Segment) error {
+	switch p := w.syncPolicy.(type) {
+	case Always:
+		return w.fsync(seg)
+	case GroupCommit:
+		return w.groupCommit.join(w, p, seg)
+	default: // Never, Interval: Interval is driven by its own goroutine.
+		return nil
+	}
+}
+
+// runIntervalSync periodically fsyncs the active segment until stopc fires.
+func (w *WAL) runIntervalSync(d time.Duration, stopc <-chan struct{}) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.mtx.RLock()
+			seg := w.segment
+			w.mtx.RUnlock()
+			if err := w.fsync(seg); err != nil {
+				level.Error(w.logger).Log("msg", "interval sync failed", "err", err)
+			}
+		case <-stopc:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// TestGroupCommitAcrossRotation drives enough concurrent Log() calls, with a
+// segment size small enough to force repeated rotation mid-run, that some
+// GroupCommit generation's joiners are guaranteed to land in more than one
+// segment. Every Log() call must only return once its own record is durable,
+// regardless of which segment a concurrent caller rotated into; a flush that
+// only fsyncs whichever segment happens to be active when it runs (rather
+// than every segment its generation actually wrote to) would let this test's
+// writers race ahead of a durable fsync for the segment rotated away from.
+func TestGroupCommitAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewSizeWithOptions(log.NewNopLogger(), nil, dir, Options{
+		SegmentSize: pageSize,
+		SyncPolicy:  GroupCommit{N: 4, D: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewSizeWithOptions: %v", err)
+	}
+
+	const nWriters = 8
+	const recsPerWriter = 200 // ~80KB of records in all, over page-sized segments.
+
+	var wg sync.WaitGroup
+	errc := make(chan error, nWriters)
+	for i := 0; i < nWriters; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for j := 0; j < recsPerWriter; j++ {
+				rec := []byte(fmt.Sprintf("writer-%d-record-%d-padding-to-force-rotation", writer, j))
+				if err := w.Log(rec); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatalf("Log: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	first, last, err := w.Segments()
+	if err != nil {
+		t.Fatalf("Segments: %v", err)
+	}
+	if last == first {
+		t.Fatalf("test didn't exercise rotation: only one segment (%d) was created", first)
+	}
+
+	sr, err := NewSegmentsReader(dir)
+	if err != nil {
+		t.Fatalf("NewSegmentsReader: %v", err)
+	}
+	defer sr.Close()
+
+	r := NewReader(sr)
+	got := 0
+	for r.Next() {
+		got++
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Reader.Err: %v", err)
+	}
+	if want := nWriters * recsPerWriter; got != want {
+		t.Fatalf("read back %d records, want %d", got, want)
+	}
+}